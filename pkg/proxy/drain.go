@@ -0,0 +1,67 @@
+// Copyright 2016-2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"time"
+
+	"github.com/cilium/cilium/pkg/policy"
+)
+
+// defaultDrainTimeout is used when a redirect's policy does not specify a
+// drain timeout.
+const defaultDrainTimeout = 30 * time.Second
+
+// drainState tracks whether a redirect is in the process of being removed,
+// for status reporting.
+type drainState struct {
+	draining bool
+	deadline time.Time
+}
+
+// drainTimeoutFromL4Filter returns the drain timeout declared on the policy
+// rule backing this redirect, falling back to defaultDrainTimeout when
+// unset.
+func drainTimeoutFromL4Filter(l4 *policy.L4Filter) time.Duration {
+	if l4.DrainTimeout == 0 {
+		return defaultDrainTimeout
+	}
+	return l4.DrainTimeout
+}
+
+// startDrain marks the redirect as draining with the given deadline.
+func (r *Redirect) startDrain(deadline time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.drain.draining = true
+	r.drain.deadline = deadline
+}
+
+// finishDrain clears the draining state once the redirect implementation
+// has been closed.
+func (r *Redirect) finishDrain() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.drain.draining = false
+}
+
+// redirectState renders a redirect's draining flag as the status API's
+// state string.
+func redirectState(draining bool) string {
+	if draining {
+		return "draining"
+	}
+	return "active"
+}
@@ -0,0 +1,150 @@
+// Copyright 2016-2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"time"
+
+	"github.com/cilium/cilium/pkg/completion"
+	"github.com/cilium/cilium/pkg/envoy"
+	"github.com/cilium/cilium/pkg/policy"
+)
+
+// envoyProxy records the xDS server passed to the most recent
+// createEnvoyRedirect call (nil until the first one) so that
+// package level helpers such as ChangeLogLevel can reach it without having
+// to thread a *Proxy through every call site.
+var envoyProxy *envoy.XDSServer
+
+func init() {
+	RegisterL7Parser(httpParserFactory{})
+}
+
+// httpParserFactory registers policy.ParserTypeHTTP as being backed by the
+// shared Envoy proxy instance.
+type httpParserFactory struct{}
+
+func (httpParserFactory) Name() policy.L7ParserType {
+	return policy.ParserTypeHTTP
+}
+
+func (httpParserFactory) Create(redir *Redirect, opts ParserOpts) (RedirectImplementation, error) {
+	return createEnvoyRedirect(redir, opts.StateDir, opts.XDSServer, opts.WaitGroup, opts.UpstreamProxy)
+}
+
+// envoyRedirect is the RedirectImplementation backed by the shared Envoy
+// proxy instance.
+type envoyRedirect struct {
+	redirect      *Redirect
+	xdsServer     *envoy.XDSServer
+	upstreamProxy *UpstreamProxyConfig
+}
+
+// createEnvoyRedirect creates a new HTTP redirect backed by Envoy. The
+// listener is configured with one virtual host per host/SNI selector
+// declared on the redirect, plus a catch-all virtual host so that requests
+// without a matching Host/SNI still fall back to the original single
+// upstream behavior. If upstreamProxy is non-nil, the generated cluster
+// reaches external destinations through it via an HTTP CONNECT transport
+// socket instead of dialing them directly.
+func createEnvoyRedirect(redir *Redirect, stateDir string, xdsServer *envoy.XDSServer, wg *completion.WaitGroup, upstreamProxy *UpstreamProxyConfig) (RedirectImplementation, error) {
+	envoyProxy = xdsServer
+
+	r := &envoyRedirect{
+		redirect:      redir,
+		xdsServer:     xdsServer,
+		upstreamProxy: upstreamProxy,
+	}
+
+	if err := r.UpdateRules(wg); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// UpdateRules pushes the redirect's current host/SNI selectors down to
+// Envoy as virtual-host (HTTP) or filter-chain SNI (TLS passthrough)
+// matchers on the shared listener for this redirect's proxy port.
+func (r *envoyRedirect) UpdateRules(wg *completion.WaitGroup) error {
+	virtualHosts := make([]envoy.VirtualHostMatch, 0, len(r.redirect.hostMatches)+1)
+	for _, hm := range r.redirect.hostMatches {
+		virtualHosts = append(virtualHosts, envoy.VirtualHostMatch{
+			Domains: []string{hm.Host},
+			SNI:     hm.SNI,
+		})
+	}
+	// A catch-all virtual host preserves the original single-upstream,
+	// port-only redirect behavior when no host/SNI selectors are set.
+	virtualHosts = append(virtualHosts, envoy.VirtualHostMatch{Domains: []string{"*"}})
+
+	if r.redirect.retryPolicy.MaxAttempts > 1 {
+		if err := r.xdsServer.UpsertRouteRetryPolicy(r.redirect.ProxyPort, envoy.RetryPolicy{
+			NumRetries:           r.redirect.retryPolicy.MaxAttempts - 1,
+			PerTryTimeout:        r.redirect.retryPolicy.PerTryTimeout,
+			RetriableStatusCodes: r.redirect.retryPolicy.RetriableStatusCodes,
+		}, wg); err != nil {
+			return err
+		}
+	}
+
+	if r.upstreamProxy != nil {
+		if err := r.xdsServer.UpsertCluster(r.redirect.ProxyPort, envoy.ConnectProxyConfig{
+			Address:  r.upstreamProxy.Address,
+			Username: r.upstreamProxy.Username,
+			Password: r.upstreamProxy.Password,
+		}, wg); err != nil {
+			return err
+		}
+	}
+
+	return r.xdsServer.UpsertListener(r.redirect.ProxyPort, virtualHosts, wg)
+}
+
+// Drain stops the listener from accepting new connections, leaving
+// in-flight requests to finish until deadline. If the listener's most
+// recent xDS update has not yet been ACKed by Envoy, Drain blocks and
+// retries until it has been (or deadline passes), so that Envoy is not
+// asked to stop listening on a configuration it may not have applied yet,
+// and so that the caller can rely on the listener having actually stopped
+// accepting connections once Drain returns.
+func (r *envoyRedirect) Drain(deadline time.Time, wg *completion.WaitGroup) {
+	for r.xdsServer.HasPendingACK(r.redirect.ProxyPort) && time.Now().Before(deadline) {
+		log.WithField(fieldProxyRedirectID, r.redirect.id).
+			Debug("Envoy xDS ACK still outstanding, retrying drain")
+		time.Sleep(time.Second)
+	}
+
+	r.xdsServer.StopAcceptingConnections(r.redirect.ProxyPort, deadline, wg)
+}
+
+// ActiveConnections returns the number of HTTP connections Envoy's admin
+// stats currently report as active on this redirect's listener.
+func (r *envoyRedirect) ActiveConnections() int {
+	return r.xdsServer.ActiveConnections(r.redirect.ProxyPort)
+}
+
+// RetryStats reports how Envoy's native route retry policy (configured in
+// UpdateRules) has played out for this redirect, read back from Envoy's
+// per-cluster admin stats. Unlike the Kafka path, HTTP retries are executed
+// inside Envoy itself, so there is nothing for this package to count locally.
+func (r *envoyRedirect) RetryStats() (attempts, successes, giveups int64) {
+	return r.xdsServer.RetryStats(r.redirect.ProxyPort)
+}
+
+// Close removes the Envoy listener backing this redirect.
+func (r *envoyRedirect) Close(wg *completion.WaitGroup) {
+	r.xdsServer.RemoveListener(r.redirect.ProxyPort, wg)
+}
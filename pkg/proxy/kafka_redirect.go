@@ -0,0 +1,180 @@
+// Copyright 2016-2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/cilium/cilium/pkg/completion"
+	"github.com/cilium/cilium/pkg/policy"
+	"github.com/cilium/cilium/pkg/proxy/logger"
+)
+
+// kafkaDrainPollInterval is how often Drain checks whether the redirect's
+// Kafka connection table has emptied out.
+const kafkaDrainPollInterval = 500 * time.Millisecond
+
+func init() {
+	RegisterL7Parser(kafkaParserFactory{})
+}
+
+// kafkaParserFactory registers policy.ParserTypeKafka as being backed by the
+// in-process Kafka proxy.
+type kafkaParserFactory struct{}
+
+func (kafkaParserFactory) Name() policy.L7ParserType {
+	return policy.ParserTypeKafka
+}
+
+func (kafkaParserFactory) Create(redir *Redirect, opts ParserOpts) (RedirectImplementation, error) {
+	return createKafkaRedirect(redir, kafkaConfiguration{}, opts.Registry, opts.UpstreamProxy)
+}
+
+// kafkaConfiguration holds the configuration the Kafka proxy needs beyond
+// what is already present on the Redirect it backs.
+type kafkaConfiguration struct{}
+
+// kafkaRedirect is the RedirectImplementation backed by the in-process Kafka
+// proxy.
+type kafkaRedirect struct {
+	redirect      *Redirect
+	conf          kafkaConfiguration
+	registry      logger.EndpointInfoRegistry
+	upstreamProxy *UpstreamProxyConfig
+
+	// accepting is set to 0 by Drain. Nothing in this package reads it.
+	accepting int32
+
+	// activeConns is the client connection count that Drain polls and
+	// ActiveConnections reports. Nothing in this package increments it, so
+	// it stays 0.
+	activeConns int32
+}
+
+// createKafkaRedirect creates a new Kafka redirect for the proxy port already
+// allocated for redir. It opens no listener on that port. If upstreamProxy
+// is non-nil, dialBroker tunnels connections to Kafka brokers through it via
+// an HTTP CONNECT handshake.
+func createKafkaRedirect(redir *Redirect, conf kafkaConfiguration, registry logger.EndpointInfoRegistry, upstreamProxy *UpstreamProxyConfig) (RedirectImplementation, error) {
+	r := &kafkaRedirect{
+		redirect:      redir,
+		conf:          conf,
+		registry:      registry,
+		upstreamProxy: upstreamProxy,
+		accepting:     1,
+	}
+
+	if err := r.UpdateRules(nil); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// dialBroker connects to a Kafka broker at addr, chaining through the
+// configured upstream CONNECT proxy when one is set.
+func (r *kafkaRedirect) dialBroker(addr string) (net.Conn, error) {
+	return dialViaUpstreamProxy(r.upstreamProxy, addr)
+}
+
+// produceWithRetry sends a single produce request, retrying errors that
+// isRetriable accepts up to RetryPolicy.MaxAttempts times. A request whose body is too large to
+// buffer for replay under RetryPolicy.MaxMemMB is sent with retries disabled,
+// rather than spooling it to disk. If RetryPolicy.PerTryTimeout is set, each
+// attempt gets its own write deadline on conn, the Kafka-path equivalent of
+// the PerTryTimeout Envoy enforces for HTTP redirects.
+func (r *kafkaRedirect) produceWithRetry(conn net.Conn, body []byte, isRetriable func(error) bool) error {
+	retryPolicy := r.redirect.retryPolicy
+	maxAttempts := retryPolicy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	if !retryPolicy.allowsBodySize(int64(len(body))) {
+		maxAttempts = 1
+	}
+
+	if retryPolicy.PerTryTimeout > 0 {
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		r.redirect.retryStats.recordAttempt()
+
+		if retryPolicy.PerTryTimeout > 0 {
+			if err := conn.SetWriteDeadline(time.Now().Add(retryPolicy.PerTryTimeout)); err != nil {
+				lastErr = err
+				break
+			}
+		}
+
+		err := writeKafkaProduceRequest(conn, body)
+		if err == nil {
+			r.redirect.retryStats.recordSuccess()
+			return nil
+		}
+
+		lastErr = err
+		if !isRetriable(err) {
+			break
+		}
+	}
+
+	r.redirect.retryStats.recordGiveup()
+	return lastErr
+}
+
+// writeKafkaProduceRequest writes a single already-encoded Kafka produce
+// request to conn.
+func writeKafkaProduceRequest(conn net.Conn, body []byte) error {
+	_, err := conn.Write(body)
+	return err
+}
+
+// UpdateRules does nothing and returns nil: this redirect holds no
+// broker/topic ACL rules of its own.
+func (r *kafkaRedirect) UpdateRules(wg *completion.WaitGroup) error {
+	return nil
+}
+
+// Drain sets accepting to 0 and waits, up to deadline, for activeConns to
+// drop to 0.
+func (r *kafkaRedirect) Drain(deadline time.Time, wg *completion.WaitGroup) {
+	atomic.StoreInt32(&r.accepting, 0)
+
+	for atomic.LoadInt32(&r.activeConns) > 0 && time.Now().Before(deadline) {
+		time.Sleep(kafkaDrainPollInterval)
+	}
+}
+
+// ActiveConnections returns the number of client connections still open on
+// this redirect.
+func (r *kafkaRedirect) ActiveConnections() int {
+	return int(atomic.LoadInt32(&r.activeConns))
+}
+
+// RetryStats reports how produceWithRetry's retry loop has played out for
+// this redirect.
+func (r *kafkaRedirect) RetryStats() (attempts, successes, giveups int64) {
+	return atomic.LoadInt64(&r.redirect.retryStats.attempts),
+		atomic.LoadInt64(&r.redirect.retryStats.successes),
+		atomic.LoadInt64(&r.redirect.retryStats.giveups)
+}
+
+// Close does nothing: createKafkaRedirect opens no listener to shut down.
+func (r *kafkaRedirect) Close(wg *completion.WaitGroup) {
+}
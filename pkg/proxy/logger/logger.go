@@ -0,0 +1,82 @@
+// Copyright 2016-2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logger defines the types and settings of the access log pipeline
+// shared by all L7 proxies (Envoy, Kafka, ...): looking up endpoint metadata
+// for a connection, and notifying interested parties of the resulting access
+// log records.
+package logger
+
+import (
+	"net"
+
+	"github.com/cilium/cilium/pkg/identity"
+)
+
+// FieldFilePath is the logrus field name used when logging the configured
+// access log file path.
+const FieldFilePath = "filePath"
+
+// EndpointInfoSource is implemented by endpoints so that the proxy can
+// attach identity and label metadata to redirects and access log records.
+type EndpointInfoSource interface {
+	GetID() uint64
+	GetIdentity() identity.NumericIdentity
+	GetLabels() []string
+	GetLabelsSHA() string
+}
+
+// EndpointInfoRegistry looks up EndpointInfoSource by IP address, used by
+// the access log server and the Kafka proxy to annotate records for
+// connections that did not originate the redirect itself (e.g. the
+// destination side of a connection).
+type EndpointInfoRegistry interface {
+	FillEndpointInfo(ip net.IP) (EndpointInfoSource, bool)
+}
+
+// LogRecordNotifier is implemented by consumers that want to be notified of
+// every L7 access log record produced by the proxies.
+type LogRecordNotifier interface {
+	NewProxyLogRecord(l *LogRecord) error
+}
+
+// LogRecord is a single L7 access log entry.
+type LogRecord struct {
+	ObservationPoint string
+	Info             string
+}
+
+var (
+	notifier LogRecordNotifier
+	metadata []string
+	logPath  string
+)
+
+// SetNotifier sets the global access log notifier.
+func SetNotifier(n LogRecordNotifier) {
+	notifier = n
+}
+
+// SetMetadata sets the extra metadata labels attached to every access log
+// record produced from this agent.
+func SetMetadata(labels []string) {
+	metadata = labels
+}
+
+// OpenLogfile records path as the access log file path and returns nil. It
+// does not open or create the file.
+func OpenLogfile(path string) error {
+	logPath = path
+	return nil
+}
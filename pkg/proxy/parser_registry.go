@@ -0,0 +1,103 @@
+// Copyright 2016-2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/cilium/cilium/pkg/completion"
+	"github.com/cilium/cilium/pkg/envoy"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/policy"
+	"github.com/cilium/cilium/pkg/proxy/logger"
+)
+
+// errUnsupportedL7Parser is the sentinel wrapped by createRedirectImplementation
+// when no factory is registered for the requested parser type. Retrying
+// will not register a factory, so callers should treat it as terminal
+// rather than retrying redirectCreationAttempts times.
+var errUnsupportedL7Parser = errors.New("unsupported L7 parser type")
+
+// ParserOpts bundles the context an L7ParserFactory needs to stand up a
+// RedirectImplementation, so that out-of-tree parsers do not need to depend
+// on the internals of Proxy.
+type ParserOpts struct {
+	StateDir      string
+	XDSServer     *envoy.XDSServer
+	UpstreamProxy *UpstreamProxyConfig
+	Registry      logger.EndpointInfoRegistry
+	WaitGroup     *completion.WaitGroup
+}
+
+// L7ParserFactory is implemented by each supported L7 parser so that it can
+// be registered with the proxy without Proxy.CreateOrUpdateRedirect needing
+// to know about it ahead of time. This allows out-of-tree parsers (gRPC,
+// DNS, MySQL, Redis, MongoDB, ...) to be added without patching proxy.go.
+type L7ParserFactory interface {
+	// Name returns the policy.L7ParserType this factory implements.
+	Name() policy.L7ParserType
+
+	// Create builds a new RedirectImplementation for redir.
+	Create(redir *Redirect, opts ParserOpts) (RedirectImplementation, error)
+}
+
+var (
+	parserRegistryMutex lock.RWMutex
+	parserRegistry      = make(map[policy.L7ParserType]L7ParserFactory)
+)
+
+// RegisterL7Parser registers f as the factory responsible for f.Name(). It
+// is typically called from an init() function of the package implementing
+// the parser. Registering a factory under a name that is already registered
+// replaces the previous factory.
+func RegisterL7Parser(f L7ParserFactory) {
+	parserRegistryMutex.Lock()
+	defer parserRegistryMutex.Unlock()
+	parserRegistry[f.Name()] = f
+}
+
+// lookupL7Parser returns the factory registered for t, if any.
+func lookupL7Parser(t policy.L7ParserType) (L7ParserFactory, bool) {
+	parserRegistryMutex.RLock()
+	defer parserRegistryMutex.RUnlock()
+	f, ok := parserRegistry[t]
+	return f, ok
+}
+
+// registeredParserNames returns the names of all currently registered L7
+// parsers, sorted, for status reporting.
+func registeredParserNames() []string {
+	parserRegistryMutex.RLock()
+	defer parserRegistryMutex.RUnlock()
+
+	names := make([]string, 0, len(parserRegistry))
+	for name := range parserRegistry {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// createRedirectImplementation looks up the factory registered for
+// l4.L7Parser and uses it to create a RedirectImplementation for redir.
+func createRedirectImplementation(l4 *policy.L4Filter, redir *Redirect, opts ParserOpts) (RedirectImplementation, error) {
+	factory, ok := lookupL7Parser(l4.L7Parser)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errUnsupportedL7Parser, l4.L7Parser)
+	}
+	return factory.Create(redir, opts)
+}
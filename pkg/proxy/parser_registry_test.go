@@ -0,0 +1,127 @@
+// Copyright 2016-2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cilium/cilium/pkg/completion"
+	"github.com/cilium/cilium/pkg/policy"
+)
+
+const mockParserType policy.L7ParserType = "test-mock"
+
+// mockRedirectImplementation is a no-op RedirectImplementation used to
+// exercise the parser registry without depending on Envoy or Kafka.
+type mockRedirectImplementation struct {
+	updateCount int
+	closed      bool
+}
+
+func (m *mockRedirectImplementation) UpdateRules(wg *completion.WaitGroup) error {
+	m.updateCount++
+	return nil
+}
+
+func (m *mockRedirectImplementation) Drain(deadline time.Time, wg *completion.WaitGroup) {
+}
+
+func (m *mockRedirectImplementation) ActiveConnections() int {
+	return 0
+}
+
+func (m *mockRedirectImplementation) RetryStats() (attempts, successes, giveups int64) {
+	return 0, 0, 0
+}
+
+func (m *mockRedirectImplementation) Close(wg *completion.WaitGroup) {
+	m.closed = true
+}
+
+// mockParserFactory registers mockParserType, handing back a single shared
+// mockRedirectImplementation so the test can observe its lifecycle.
+type mockParserFactory struct {
+	impl *mockRedirectImplementation
+}
+
+func (f *mockParserFactory) Name() policy.L7ParserType {
+	return mockParserType
+}
+
+func (f *mockParserFactory) Create(redir *Redirect, opts ParserOpts) (RedirectImplementation, error) {
+	return f.impl, nil
+}
+
+func TestRegisterL7Parser(t *testing.T) {
+	factory := &mockParserFactory{impl: &mockRedirectImplementation{}}
+	RegisterL7Parser(factory)
+
+	found, ok := lookupL7Parser(mockParserType)
+	if !ok {
+		t.Fatalf("expected mock parser to be registered")
+	}
+	if found.Name() != mockParserType {
+		t.Fatalf("expected registered factory name %q, got %q", mockParserType, found.Name())
+	}
+
+	names := registeredParserNames()
+	var seen bool
+	for _, n := range names {
+		if n == string(mockParserType) {
+			seen = true
+		}
+	}
+	if !seen {
+		t.Fatalf("expected %q in registered parser names %v", mockParserType, names)
+	}
+}
+
+func TestCreateRedirectImplementationUsesRegisteredFactory(t *testing.T) {
+	factory := &mockParserFactory{impl: &mockRedirectImplementation{}}
+	RegisterL7Parser(factory)
+
+	l4 := &policy.L4Filter{L7Parser: mockParserType}
+	redir := newRedirect(0, nil, "test-redirect")
+
+	impl, err := createRedirectImplementation(l4, redir, ParserOpts{})
+	if err != nil {
+		t.Fatalf("unexpected error creating redirect implementation: %s", err)
+	}
+	if impl != factory.impl {
+		t.Fatalf("expected the registered factory's implementation to be returned")
+	}
+
+	if err := impl.UpdateRules(nil); err != nil {
+		t.Fatalf("unexpected error updating rules: %s", err)
+	}
+	if factory.impl.updateCount != 1 {
+		t.Fatalf("expected UpdateRules to be called once, got %d", factory.impl.updateCount)
+	}
+
+	impl.Close(nil)
+	if !factory.impl.closed {
+		t.Fatalf("expected Close to mark the implementation closed")
+	}
+}
+
+func TestCreateRedirectImplementationUnknownParser(t *testing.T) {
+	l4 := &policy.L4Filter{L7Parser: "does-not-exist"}
+	redir := newRedirect(0, nil, "test-redirect")
+
+	if _, err := createRedirectImplementation(l4, redir, ParserOpts{}); err == nil {
+		t.Fatalf("expected an error for an unregistered L7 parser type")
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2016-2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/policy"
+)
+
+// proxyPortsFile is the name of the file, relative to stateDir, that proxy
+// port reservations are persisted to.
+const proxyPortsFile = "proxy-ports.json"
+
+// portReservation is a single persisted proxy port allocation.
+type portReservation struct {
+	ID             string              `json:"id"`
+	Port           uint16              `json:"port"`
+	Parser         policy.L7ParserType `json:"parser"`
+	AllocatedAt    time.Time           `json:"allocated-at"`
+	PendingRelease bool                `json:"pending-release,omitempty"`
+}
+
+// portStore persists proxy port reservations to stateDir so that a
+// restarting agent can reuse the same proxy ports for existing endpoints
+// rather than reshuffling them.
+type portStore struct {
+	mutex lock.Mutex
+	path  string
+	byID  map[string]*portReservation
+}
+
+// newPortStore creates a portStore backed by proxyPortsFile under stateDir.
+func newPortStore(stateDir string) *portStore {
+	return &portStore{
+		path: filepath.Join(stateDir, proxyPortsFile),
+		byID: make(map[string]*portReservation),
+	}
+}
+
+// load reads any previously persisted reservations from disk and discards
+// ones that are no longer valid: outside [rangeMin,rangeMax], or still
+// marked pending-release from a crash between RemoveRedirect and the
+// delayed port release (see markPendingRelease). Discarded reservations are
+// pruned from s.byID, not just from the returned slice, so that
+// reservedPortFor and the status API never hand out a reservation that was
+// rejected here. A missing file is not an error: it simply means no
+// reservations exist yet (e.g. on first start).
+func (s *portStore) load(rangeMin, rangeMax uint16) ([]portReservation, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var reservations []portReservation
+	if err := json.Unmarshal(data, &reservations); err != nil {
+		return nil, err
+	}
+
+	valid := reconcilePortReservations(reservations, rangeMin, rangeMax)
+
+	s.mutex.Lock()
+	s.byID = make(map[string]*portReservation, len(valid))
+	for i := range valid {
+		s.byID[valid[i].ID] = &valid[i]
+	}
+	s.mutex.Unlock()
+
+	if len(valid) != len(reservations) {
+		if err := s.persist(); err != nil {
+			// s.byID already reflects valid regardless of whether the
+			// write-back succeeded, so the caller must still use valid: a
+			// nil here would desync allocatedPorts (seeded from the
+			// returned slice) from s.byID (consulted by reservedPortFor),
+			// letting allocatePort hand the same port out twice.
+			return valid, err
+		}
+	}
+
+	return valid, nil
+}
+
+// reserve records that port has been allocated to the redirect identified by
+// id, using the given L7 parser, and persists the updated reservation set.
+func (s *portStore) reserve(id string, port uint16, parser policy.L7ParserType) error {
+	s.mutex.Lock()
+	s.byID[id] = &portReservation{
+		ID:          id,
+		Port:        port,
+		Parser:      parser,
+		AllocatedAt: time.Now(),
+	}
+	s.mutex.Unlock()
+
+	return s.persist()
+}
+
+// markPendingRelease flags the reservation for id as pending release, so
+// that a crash between RemoveRedirect and the delayed port release does not
+// leak the allocation on the next restart.
+func (s *portStore) markPendingRelease(id string) error {
+	s.mutex.Lock()
+	if r, ok := s.byID[id]; ok {
+		r.PendingRelease = true
+	}
+	s.mutex.Unlock()
+
+	return s.persist()
+}
+
+// reservedPortFor returns the previously persisted port for id, if any.
+func (s *portStore) reservedPortFor(id string) (uint16, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	r, ok := s.byID[id]
+	if !ok {
+		return 0, false
+	}
+	return r.Port, true
+}
+
+// snapshot returns the currently known reservations, for status reporting.
+func (s *portStore) snapshot() []portReservation {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	reservations := make([]portReservation, 0, len(s.byID))
+	for _, r := range s.byID {
+		reservations = append(reservations, *r)
+	}
+	return reservations
+}
+
+// release forgets the reservation for id, provided it is still the one for
+// port, and persists the updated set. If id has since been reserved for a
+// different port - e.g. the same redirect id was recreated while this
+// release was delayed by portReleaseDelay - the newer reservation is left
+// alone rather than being deleted out from under the new redirect.
+func (s *portStore) release(id string, port uint16) error {
+	s.mutex.Lock()
+	if r, ok := s.byID[id]; ok && r.Port == port {
+		delete(s.byID, id)
+	}
+	s.mutex.Unlock()
+
+	return s.persist()
+}
+
+// persist writes the current reservation set to disk. Callers must not hold
+// s.mutex.
+func (s *portStore) persist() error {
+	s.mutex.Lock()
+	reservations := make([]portReservation, 0, len(s.byID))
+	for _, r := range s.byID {
+		reservations = append(reservations, *r)
+	}
+	s.mutex.Unlock()
+
+	data, err := json.Marshal(reservations)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(s.path, data, 0644)
+}
+
+// reconcilePortReservations validates loaded reservations against [rangeMin,rangeMax] and
+// discards any reservation still marked pending-release. Reservations that
+// fail either check are dropped (and not returned) so that allocatePort is
+// free to hand the port out again.
+//
+// This deliberately does not probe each port with net.Listen to check it is
+// free: the common case this feature exists for is an agent restart where
+// our own Envoy/proxy listener is still bound on the reserved port, and such
+// a probe would fail and discard the very reservation we want to keep,
+// causing ports to reshuffle on every upgrade instead of being reused. If a
+// reserved port turns out to actually be held by something else, the
+// allocation retry loop in CreateOrUpdateRedirect already falls back to a
+// freshly allocated port after the first failed attempt.
+func reconcilePortReservations(reservations []portReservation, rangeMin, rangeMax uint16) []portReservation {
+	valid := make([]portReservation, 0, len(reservations))
+	for _, r := range reservations {
+		if r.PendingRelease {
+			log.WithField(fieldProxyRedirectID, r.ID).
+				Warningf("Discarding persisted proxy port %d: still marked pending-release from a prior run", r.Port)
+			continue
+		}
+
+		if r.Port < rangeMin || r.Port > rangeMax {
+			log.WithField(fieldProxyRedirectID, r.ID).
+				Warningf("Discarding persisted proxy port %d: outside of configured range [%d,%d]", r.Port, rangeMin, rangeMax)
+			continue
+		}
+
+		valid = append(valid, r)
+	}
+	return valid
+}
@@ -15,6 +15,7 @@
 package proxy
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"sync"
@@ -38,6 +39,11 @@ import (
 
 var (
 	log = logging.DefaultLogger
+
+	// DefaultEndpointInfoRegistry is the registry consulted by the access
+	// log server and the Kafka proxy to resolve destination endpoints that
+	// did not themselves originate a redirect.
+	DefaultEndpointInfoRegistry logger.EndpointInfoRegistry
 )
 
 // field names used while logging
@@ -81,11 +87,51 @@ type Proxy struct {
 	// the redirect identifier. Redirects may be implemented by different
 	// proxies.
 	redirects map[string]*Redirect
+
+	// draining holds redirects that RemoveRedirect has taken out of
+	// redirects but that are still draining or closing, so that they
+	// remain visible to getRedirectsStatusModel until that finishes.
+	draining map[string]*Redirect
+
+	// upstreamProxy, if set, is the HTTP(S) CONNECT proxy that egress
+	// redirects chain their outbound connections through.
+	upstreamProxy *UpstreamProxyConfig
+
+	// ports persists proxy port allocations across agent restarts so that
+	// existing endpoints keep their proxy port rather than being reshuffled
+	// on every upgrade.
+	ports *portStore
 }
 
 // StartProxySupport starts the servers to support L7 proxies: xDS GRPC server
-// and access log server.
-func StartProxySupport(minPort uint16, maxPort uint16, stateDir string) *Proxy {
+// and access log server. upstreamProxy may be nil, in which case egress
+// redirects dial their destinations directly. extraParsers are registered in
+// addition to the built-in ParserTypeHTTP and ParserTypeKafka parsers,
+// letting callers plug in out-of-tree L7 parsers.
+func StartProxySupport(minPort uint16, maxPort uint16, stateDir string, upstreamProxy *UpstreamProxyConfig, extraParsers ...L7ParserFactory) *Proxy {
+	for _, f := range extraParsers {
+		RegisterL7Parser(f)
+	}
+
+	ports := newPortStore(stateDir)
+	// reservations reflects ports.byID even when err is non-nil (e.g. a
+	// failure to persist pruned-out entries), so it must still be used to
+	// seed allocatedPorts below: discarding it here would let allocatePort
+	// hand out a port reservedPortFor still considers reserved.
+	reservations, err := ports.load(minPort, maxPort)
+	if err != nil {
+		log.WithError(err).Warning("Unable to fully load persisted proxy port reservations")
+	}
+
+	allocatedPorts := make(map[uint16]*Redirect, len(reservations))
+	for _, r := range reservations {
+		// The Redirect itself is recreated lazily the next time
+		// CreateOrUpdateRedirect is called for r.ID; until then, the port is
+		// held reserved here purely to keep allocatePort from handing it out
+		// to an unrelated redirect.
+		allocatedPorts[r.Port] = nil
+	}
+
 	xdsServer := envoy.StartXDSServer(stateDir)
 	envoy.StartAccessLogServer(stateDir, xdsServer, DefaultEndpointInfoRegistry)
 	return &Proxy{
@@ -94,7 +140,10 @@ func StartProxySupport(minPort uint16, maxPort uint16, stateDir string) *Proxy {
 		rangeMin:       minPort,
 		rangeMax:       maxPort,
 		redirects:      make(map[string]*Redirect),
-		allocatedPorts: make(map[uint16]*Redirect),
+		draining:       make(map[string]*Redirect),
+		allocatedPorts: allocatedPorts,
+		ports:          ports,
+		upstreamProxy:  upstreamProxy,
 	}
 }
 
@@ -186,25 +235,45 @@ func (p *Proxy) CreateOrUpdateRedirect(l4 *policy.L4Filter, id string, source lo
 	redir.parserType = l4.L7Parser
 	redir.updateRules(l4)
 
+	// Reuse the proxy port reserved for this redirect ID across a prior
+	// agent restart, if one is still free, instead of allocating a new one.
+	reservedPort, hasReservation := p.ports.reservedPortFor(id)
+	if hasReservation {
+		if occupant, ok := p.allocatedPorts[reservedPort]; ok && occupant != nil {
+			// The redirect previously bound to this port (including one for
+			// this same id that is being recreated right after removal) has
+			// not finished draining/closing yet: RemoveRedirect keeps the
+			// port marked allocated well past Close to guarantee it is safe
+			// to reuse. Fall back to allocating a fresh port rather than
+			// handing this one to a brand new implementation.
+			hasReservation = false
+		}
+	}
+
 retryCreatePort:
 	for nRetry := 0; ; nRetry++ {
-		to, err := p.allocatePort()
-		if err != nil {
-			return nil, err
+		var to uint16
+		var err error
+
+		if hasReservation {
+			to = reservedPort
+			hasReservation = false
+		} else {
+			to, err = p.allocatePort()
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		redir.ProxyPort = to
 
-		switch l4.L7Parser {
-		case policy.ParserTypeKafka:
-			redir.implementation, err = createKafkaRedirect(redir, kafkaConfiguration{}, DefaultEndpointInfoRegistry)
-
-		case policy.ParserTypeHTTP:
-			redir.implementation, err = createEnvoyRedirect(redir, p.stateDir, p.XDSServer, wg)
-
-		default:
-			return nil, fmt.Errorf("unsupported L7 parser type: %s", l4.L7Parser)
-		}
+		redir.implementation, err = createRedirectImplementation(l4, redir, ParserOpts{
+			StateDir:      p.stateDir,
+			XDSServer:     p.XDSServer,
+			UpstreamProxy: p.upstreamProxy,
+			Registry:      DefaultEndpointInfoRegistry,
+			WaitGroup:     wg,
+		})
 
 		switch {
 		case err == nil:
@@ -214,8 +283,19 @@ retryCreatePort:
 			p.allocatedPorts[to] = redir
 			p.redirects[id] = redir
 
+			if err := p.ports.reserve(id, to, l4.L7Parser); err != nil {
+				scopedLog.WithError(err).Warning("Unable to persist proxy port reservation")
+			}
+
 			break retryCreatePort
 
+		// no factory is registered for this parser type; retrying will not
+		// change that, so give up immediately instead of burning through
+		// redirectCreationAttempts ports
+		case errors.Is(err, errUnsupportedL7Parser):
+			scopedLog.WithError(err).Error("Unable to create ", l4.L7Parser, " proxy")
+			return nil, err
+
 		// an error occurred, and we have no more retries
 		case nRetry >= redirectCreationAttempts:
 			scopedLog.WithError(err).Error("Unable to create ", l4.L7Parser, " proxy")
@@ -233,21 +313,56 @@ retryCreatePort:
 // RemoveRedirect removes an existing redirect.
 func (p *Proxy) RemoveRedirect(id string, wg *completion.WaitGroup) error {
 	p.mutex.Lock()
-	defer p.mutex.Unlock()
 	r, ok := p.redirects[id]
 	if !ok {
+		p.mutex.Unlock()
 		return fmt.Errorf("unable to find redirect %s", id)
 	}
 
-	log.WithField(fieldProxyRedirectID, id).
-		Debug("removing proxy redirect")
-	r.implementation.Close(wg)
-
+	// Move id from p.redirects to p.draining synchronously, before draining
+	// starts, so that a concurrent CreateOrUpdateRedirect for the same id
+	// cannot hit the update branch and call UpdateRules on a redirect that
+	// is in the middle of draining or closing; it will instead build a
+	// fresh one. Keeping it in p.draining, rather than dropping it
+	// outright, leaves it visible to getRedirectsStatusModel until drain
+	// and close have finished.
 	delete(p.redirects, id)
+	p.draining[id] = r
+	p.mutex.Unlock()
 
-	// delay the release and reuse of the port number so it is guaranteed
-	// to be safe to listen on the port again
+	log.WithField(fieldProxyRedirectID, id).
+		Debug("draining proxy redirect")
+
+	deadline := time.Now().Add(r.drainTimeout)
+	r.startDrain(deadline)
+
+	// Mark the reservation as pending release before kicking off the
+	// drain+close below, so that a crash in between does not leak the
+	// allocation: on the next restart, reconcilePortReservations discards
+	// the reservation so that allocatePort can hand the port out again.
+	if err := p.ports.markPendingRelease(id); err != nil {
+		log.WithError(err).WithField(fieldProxyRedirectID, id).
+			Warning("Unable to persist pending release of proxy port reservation")
+	}
+
+	// Draining (and the subsequent Close) can block for up to the drain
+	// timeout waiting for in-flight requests, so it must not hold p.mutex.
+	// It also must not be handed wg: RemoveRedirect's caller is free to
+	// Wait() on it as soon as this function returns, well before this
+	// goroutine's own completions would fire.
 	go func() {
+		r.implementation.Drain(deadline, nil)
+		r.implementation.Close(nil)
+		r.finishDrain()
+
+		p.mutex.Lock()
+		delete(p.draining, id)
+		p.mutex.Unlock()
+
+		log.WithField(fieldProxyRedirectID, id).Debug("removed proxy redirect")
+
+		// delay the release and reuse of the port number so it is guaranteed
+		// to be safe to listen on the port again
 		time.Sleep(portReleaseDelay)
 
 		// The cleanup of the proxymap is delayed a bit to ensure that
@@ -259,6 +374,11 @@ func (p *Proxy) RemoveRedirect(id string, wg *completion.WaitGroup) error {
 		delete(p.allocatedPorts, r.ProxyPort)
 		p.mutex.Unlock()
 
+		if err := p.ports.release(id, r.ProxyPort); err != nil {
+			log.WithError(err).WithField(fieldProxyRedirectID, id).
+				Warning("Unable to persist release of proxy port reservation")
+		}
+
 		log.WithField(fieldProxyRedirectID, id).Debugf("Delayed release of proxy port %d", r.ProxyPort)
 	}()
 
@@ -276,6 +396,14 @@ func getRedirectStatusModel(r *Redirect) *models.ProxyRedirectStatus {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 
+	// Rules has historically reported the redirect's L7 selectors; until it
+	// carries its own representation of the underlying L7 policy rules, it
+	// mirrors HostSelectors rather than duplicating getHostSelectorsModel's
+	// body under a second name.
+	hostSelectors := r.getHostSelectorsModel()
+
+	attempts, successes, giveups := r.implementation.RetryStats()
+
 	return &models.ProxyRedirectStatus{
 		Protocol:           string(r.parserType),
 		Port:               int64(r.port),
@@ -286,21 +414,30 @@ func getRedirectStatusModel(r *Redirect) *models.ProxyRedirectStatus {
 			Labels:       r.source.GetLabels(),
 			LabelsSHA256: r.source.GetLabelsSHA(),
 		},
-		Location:    r.getLocation(),
-		Created:     strfmt.DateTime(r.created),
-		LastUpdated: strfmt.DateTime(r.lastUpdated),
-		Rules:       r.getRulesModel(),
+		Location:          r.getLocation(),
+		Created:           strfmt.DateTime(r.created),
+		LastUpdated:       strfmt.DateTime(r.lastUpdated),
+		Rules:             hostSelectors,
+		HostSelectors:     hostSelectors,
+		RetryAttempts:     attempts,
+		RetrySuccesses:    successes,
+		RetryGiveups:      giveups,
+		State:             redirectState(r.drain.draining),
+		ActiveConnections: int64(r.implementation.ActiveConnections()),
 	}
 }
 
-// getRedirectStatusModel returns the status of all redirects
+// getRedirectsStatusModel returns the status of all redirects, including
+// those still draining, so that redirectState's "draining" state and
+// ActiveConnections remain observable until a redirect is fully closed.
 func (p *Proxy) getRedirectsStatusModel() []*models.ProxyRedirectStatus {
-	redirects := make([]*models.ProxyRedirectStatus, len(p.redirects))
+	redirects := make([]*models.ProxyRedirectStatus, 0, len(p.redirects)+len(p.draining))
 
-	idx := 0
 	for _, redirect := range p.redirects {
-		redirects[idx] = getRedirectStatusModel(redirect)
-		idx++
+		redirects = append(redirects, getRedirectStatusModel(redirect))
+	}
+	for _, redirect := range p.draining {
+		redirects = append(redirects, getRedirectStatusModel(redirect))
 	}
 
 	return redirects
@@ -312,8 +449,26 @@ func (p *Proxy) GetStatusModel() *models.ProxyStatus {
 	defer p.mutex.RUnlock()
 
 	return &models.ProxyStatus{
-		IP:        node.GetInternalIPv4().String(),
-		PortRange: fmt.Sprintf("%d-%d", p.rangeMin, p.rangeMax),
-		Redirects: p.getRedirectsStatusModel(),
+		IP:                node.GetInternalIPv4().String(),
+		PortRange:         fmt.Sprintf("%d-%d", p.rangeMin, p.rangeMax),
+		Redirects:         p.getRedirectsStatusModel(),
+		RegisteredParsers: registeredParserNames(),
+		ReservedPorts:     reservedPortsModel(p.ports),
+	}
+}
+
+// reservedPortsModel renders the currently persisted proxy port reservations
+// for the status API.
+func reservedPortsModel(ports *portStore) []*models.ReservedProxyPort {
+	reservations := ports.snapshot()
+	model := make([]*models.ReservedProxyPort, 0, len(reservations))
+	for _, r := range reservations {
+		model = append(model, &models.ReservedProxyPort{
+			RedirectID:  r.ID,
+			Port:        int64(r.Port),
+			Parser:      string(r.Parser),
+			AllocatedAt: strfmt.DateTime(r.AllocatedAt),
+		})
 	}
+	return model
 }
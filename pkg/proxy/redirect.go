@@ -0,0 +1,173 @@
+// Copyright 2016-2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cilium/cilium/pkg/completion"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/policy"
+	"github.com/cilium/cilium/pkg/proxy/logger"
+)
+
+// RedirectImplementation is the implementation specific behavior of a
+// redirect, implemented by each supported L7 parser (Envoy for HTTP,
+// the Kafka proxy, ...).
+type RedirectImplementation interface {
+	// UpdateRules is called whenever the L4Filter backing a redirect is
+	// updated and the rules need to be pushed down to the proxy.
+	UpdateRules(wg *completion.WaitGroup) error
+
+	// Drain stops the redirect from accepting new connections and gives
+	// in-flight requests until deadline to complete before RemoveRedirect
+	// calls Close. RemoveRedirect calls Drain once; an implementation that
+	// must wait out an outstanding xDS ACK first retries inside Drain.
+	Drain(deadline time.Time, wg *completion.WaitGroup)
+
+	// ActiveConnections returns the number of connections/requests still
+	// in flight, for status reporting during drain.
+	ActiveConnections() int
+
+	// RetryStats returns how many requests through this redirect have been
+	// attempted, have eventually succeeded, and have given up, per its
+	// RetryPolicy. Each implementation tracks these against whichever layer
+	// actually executes the retries.
+	RetryStats() (attempts, successes, giveups int64)
+
+	// Close closes the redirect and releases all resources held by it.
+	Close(wg *completion.WaitGroup)
+}
+
+// HostMatch describes a single host/SNI based routing rule attached to a
+// redirect. A redirect may front more than one logical upstream on a single
+// proxy port, distinguished by the HTTP Host header (for ParserTypeHTTP) or
+// the TLS SNI (for ParserTypeHTTP with TLS termination disabled, i.e. pure
+// SNI passthrough).
+type HostMatch struct {
+	// Host is the exact Host header or SNI value to match. A leading "*."
+	// matches any single subdomain label.
+	Host string
+
+	// SNI, if true, matches against the TLS ClientHello SNI instead of the
+	// HTTP Host header. SNI matching implies the connection is forwarded
+	// without TLS termination at the proxy.
+	SNI bool
+}
+
+// String returns a human readable representation of the host match, mainly
+// used for logging.
+func (h HostMatch) String() string {
+	if h.SNI {
+		return fmt.Sprintf("sni:%s", h.Host)
+	}
+	return fmt.Sprintf("host:%s", h.Host)
+}
+
+// Redirect implements the state and lifecycle management of a single proxy
+// redirect. A redirect owns exactly one proxy port and is backed by exactly
+// one RedirectImplementation.
+type Redirect struct {
+	mutex lock.RWMutex
+
+	id         string
+	ProxyPort  uint16
+	port       uint16
+	ingress    bool
+	endpointID uint64
+	source     logger.EndpointInfoSource
+	parserType policy.L7ParserType
+
+	// hostMatches is the set of host/SNI selectors this redirect should
+	// route on, in addition to the port it is bound to. An empty slice
+	// means the redirect accepts any Host/SNI, which is the historical
+	// port-only behavior.
+	hostMatches []HostMatch
+
+	// retryPolicy governs retries of failed requests through this redirect.
+	retryPolicy RetryPolicy
+	retryStats  retryCounters
+
+	// drainTimeout bounds how long RemoveRedirect waits for in-flight
+	// requests to finish before closing this redirect.
+	drainTimeout time.Duration
+	drain        drainState
+
+	implementation RedirectImplementation
+
+	created     time.Time
+	lastUpdated time.Time
+}
+
+// newRedirect creates a new Redirect for the given proxy port, backed by the
+// endpoint information in source, identified by id.
+func newRedirect(port uint16, source logger.EndpointInfoSource, id string) *Redirect {
+	now := time.Now()
+	return &Redirect{
+		id:          id,
+		port:        port,
+		source:      source,
+		created:     now,
+		lastUpdated: now,
+	}
+}
+
+// updateRules updates the redirect's configuration from the given L4Filter,
+// including the optional host/SNI selectors.
+func (r *Redirect) updateRules(l4 *policy.L4Filter) {
+	r.hostMatches = hostMatchesFromL4Filter(l4)
+	r.retryPolicy = retryPolicyFromL4Filter(l4)
+	r.drainTimeout = drainTimeoutFromL4Filter(l4)
+}
+
+// getLocation returns a short human readable description of where this
+// redirect is attached, used in status reporting and logging.
+func (r *Redirect) getLocation() string {
+	direction := "egress"
+	if r.ingress {
+		direction = "ingress"
+	}
+	return fmt.Sprintf("%s:%d", direction, r.port)
+}
+
+// getHostSelectorsModel renders the redirect's configured host/SNI
+// selectors for the status API. Redirects without any selectors (the
+// original port-only behavior) report nil.
+func (r *Redirect) getHostSelectorsModel() []string {
+	if len(r.hostMatches) == 0 {
+		return nil
+	}
+	selectors := make([]string, 0, len(r.hostMatches))
+	for _, hm := range r.hostMatches {
+		selectors = append(selectors, hm.String())
+	}
+	return selectors
+}
+
+// hostMatchesFromL4Filter extracts the host/SNI selectors declared on the
+// policy rule backing this redirect, if any. Older policies without any
+// selectors configured result in a nil slice, which preserves the original
+// port-only redirect behavior.
+func hostMatchesFromL4Filter(l4 *policy.L4Filter) []HostMatch {
+	if len(l4.HostSelectors) == 0 {
+		return nil
+	}
+	matches := make([]HostMatch, 0, len(l4.HostSelectors))
+	for _, sel := range l4.HostSelectors {
+		matches = append(matches, HostMatch{Host: sel.Host, SNI: sel.SNI})
+	}
+	return matches
+}
@@ -0,0 +1,103 @@
+// Copyright 2016-2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cilium/cilium/pkg/policy"
+)
+
+// RetryPolicy describes how a redirect should retry failed requests, and
+// how much of a request body it may buffer in memory to make a safe replay
+// possible.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a request is tried,
+	// including the initial attempt. Zero disables retries entirely.
+	MaxAttempts int
+
+	// PerTryTimeout bounds each individual attempt.
+	PerTryTimeout time.Duration
+
+	// RetriableStatusCodes lists the HTTP status codes that are safe to
+	// retry. It is passed to Envoy for HTTP redirects only; the Kafka path
+	// decides retriability with the isRetriable function given to
+	// produceWithRetry.
+	RetriableStatusCodes []int
+
+	// MaxMemMB caps how many megabytes of a request body may be buffered
+	// to allow replay on retry. On the Kafka path, requests whose body
+	// exceeds this cap are forwarded with retries disabled rather than
+	// spooled to disk. It is not passed to Envoy, so HTTP redirects do not
+	// apply this cap.
+	MaxMemMB int
+}
+
+// retryCounters tracks how a redirect's RetryPolicy has played out, surfaced
+// in the status API as attempts/successes/giveups. Only recorded directly by
+// the Kafka path's produceWithRetry; the Envoy/HTTP path reports its own
+// counters by querying Envoy instead (see envoyRedirect.RetryStats).
+type retryCounters struct {
+	attempts  int64
+	successes int64
+	giveups   int64
+}
+
+// recordAttempt accounts for a single try of a request, successful or not.
+func (c *retryCounters) recordAttempt() {
+	atomic.AddInt64(&c.attempts, 1)
+}
+
+// recordSuccess accounts for a request that eventually succeeded, possibly
+// after one or more retries.
+func (c *retryCounters) recordSuccess() {
+	atomic.AddInt64(&c.successes, 1)
+}
+
+// recordGiveup accounts for a request that ended without succeeding, either
+// because it exhausted RetryPolicy.MaxAttempts or because an attempt failed
+// with an error that is not retriable.
+func (c *retryCounters) recordGiveup() {
+	atomic.AddInt64(&c.giveups, 1)
+}
+
+// retryPolicyFromL4Filter extracts the retry policy declared on the policy
+// rule backing this redirect, if any. Policies without a retry policy get
+// the zero value, which disables retries and preserves the original
+// best-effort forwarding behavior.
+func retryPolicyFromL4Filter(l4 *policy.L4Filter) RetryPolicy {
+	if l4.RetryPolicy == nil {
+		return RetryPolicy{}
+	}
+	return RetryPolicy{
+		MaxAttempts:          l4.RetryPolicy.MaxAttempts,
+		PerTryTimeout:        l4.RetryPolicy.PerTryTimeout,
+		RetriableStatusCodes: l4.RetryPolicy.RetriableStatusCodes,
+		MaxMemMB:             l4.RetryPolicy.MaxMemMB,
+	}
+}
+
+// allowsBodySize reports whether a request body of the given size may be
+// buffered for replay under this retry policy. A zero MaxMemMB means no
+// buffering is allowed, so any non-empty body disables retries for that
+// request.
+func (p RetryPolicy) allowsBodySize(bodyBytes int64) bool {
+	if p.MaxAttempts <= 1 {
+		return false
+	}
+	maxBytes := int64(p.MaxMemMB) * 1024 * 1024
+	return bodyBytes <= maxBytes
+}
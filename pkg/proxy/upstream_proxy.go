@@ -0,0 +1,181 @@
+// Copyright 2016-2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// UpstreamProxyConfig configures an upstream HTTP(S) CONNECT proxy that
+// egress L7 redirects (Envoy and Kafka) should chain their outbound
+// connections through, for deployments where egress must traverse a
+// corporate HTTP proxy.
+type UpstreamProxyConfig struct {
+	// Address is the host:port of the upstream CONNECT proxy.
+	Address string
+
+	// Username and Password, if set, are sent as a Proxy-Authorization:
+	// Basic header on the CONNECT request.
+	Username string
+	Password string
+
+	// TLS is used to dial Address itself when connecting to the upstream
+	// proxy over HTTPS. It is unrelated to the TLS (if any) used between
+	// the proxy and the final destination.
+	TLS *tls.Config
+
+	// NoProxy lists destination hosts (exact, or "*.example.com" suffix
+	// matches) that should bypass the upstream proxy and be dialed
+	// directly, mirroring the standard NO_PROXY environment variable.
+	NoProxy []string
+
+	// DialTimeout bounds connecting to the upstream proxy and completing
+	// the CONNECT handshake.
+	DialTimeout time.Duration
+
+	// DialRetries is the number of additional attempts to reach the
+	// upstream proxy before falling back to a direct connection to the
+	// destination.
+	DialRetries int
+}
+
+// defaultUpstreamDialTimeout is used when UpstreamProxyConfig.DialTimeout is
+// unset.
+const defaultUpstreamDialTimeout = 10 * time.Second
+
+// bypassesUpstreamProxy reports whether host should skip the upstream
+// CONNECT proxy and be dialed directly, per conf.NoProxy.
+func bypassesUpstreamProxy(conf *UpstreamProxyConfig, host string) bool {
+	for _, entry := range conf.NoProxy {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.HasPrefix(entry, "*.") {
+			if strings.HasSuffix(host, entry[1:]) {
+				return true
+			}
+			continue
+		}
+		if host == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// dialViaUpstreamProxy dials addr (a "host:port" destination) by first
+// connecting to conf.Address and issuing an HTTP CONNECT request, returning
+// the tunnel as a net.Conn ready for the caller to layer TLS or an
+// application protocol on top of. If conf is nil, or addr is covered by
+// conf.NoProxy, or no tunnel is established after 1+conf.DialRetries
+// attempts (the upstream proxy cannot be reached, or it answers the CONNECT
+// with a status other than 200), it falls back to dialing addr directly.
+func dialViaUpstreamProxy(conf *UpstreamProxyConfig, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf == nil || conf.Address == "" || bypassesUpstreamProxy(conf, host) {
+		return net.Dial("tcp", addr)
+	}
+
+	timeout := conf.DialTimeout
+	if timeout == 0 {
+		timeout = defaultUpstreamDialTimeout
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= conf.DialRetries; attempt++ {
+		conn, err := connectThroughProxy(conf, addr, timeout)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+
+	// No tunnel could be established through the upstream proxy; fall back
+	// to a direct connection rather than failing the redirect outright.
+	log.WithError(lastErr).WithField("address", conf.Address).
+		Warning("Upstream CONNECT proxy unreachable, falling back to direct dial")
+	return net.Dial("tcp", addr)
+}
+
+// connectThroughProxy performs a single attempt at dialing conf.Address and
+// completing the CONNECT handshake for addr.
+func connectThroughProxy(conf *UpstreamProxyConfig, addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var conn net.Conn
+	var err error
+	if conf.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", conf.Address, conf.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", conf.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodConnect, "http://"+addr, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if conf.Username != "" || conf.Password != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(conf.Username + ":" + conf.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for k, v := range req.Header {
+		if _, err := fmt.Fprintf(conn, "%s: %s\r\n", k, strings.Join(v, ",")); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if _, err := fmt.Fprint(conn, "\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream CONNECT proxy %s refused tunnel to %s: %s", conf.Address, addr, resp.Status)
+	}
+
+	return conn, nil
+}